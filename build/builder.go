@@ -0,0 +1,128 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/xvandish/zoekt"
+)
+
+// Builder accumulates documents and flushes them to shards on disk once
+// opts.ShardMax worth of content has been buffered, or when Finish is
+// called. Callers add documents with Add and must call Finish exactly once
+// when done.
+type Builder struct {
+	opts Options
+
+	docs         []*zoekt.Document
+	docsSize     int
+	nextShardNum int
+}
+
+// NewBuilder prepares opts.IndexDir and returns a Builder ready to Add
+// documents to.
+func NewBuilder(opts Options) (*Builder, error) {
+	opts.SetDefaults()
+	if err := os.MkdirAll(opts.IndexDir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Builder{opts: opts}, nil
+}
+
+// Add buffers doc, flushing the current batch to a shard first if doc
+// would push it over opts.ShardMax.
+func (b *Builder) Add(doc zoekt.Document) error {
+	if b.docsSize+len(doc.Content) > b.opts.ShardMax && len(b.docs) > 0 {
+		if err := b.flush(); err != nil {
+			return err
+		}
+	}
+
+	d := doc
+	b.docs = append(b.docs, &d)
+	b.docsSize += len(d.Content)
+	return nil
+}
+
+// Finish flushes any buffered documents to a final shard.
+func (b *Builder) Finish() error {
+	return b.flush()
+}
+
+// flush runs ctags (or the configured Parser) over the buffered batch and
+// writes it out as a shard.
+func (b *Builder) flush() error {
+	if len(b.docs) == 0 {
+		return nil
+	}
+
+	if err := ctagsAddSymbols(b.docs, b.opts.Parser, b.opts.CTagsPath, b.opts); err != nil {
+		return err
+	}
+
+	if err := writeShard(b.opts, b.nextShardNum, b.docs); err != nil {
+		return err
+	}
+
+	b.nextShardNum++
+	b.docs = nil
+	b.docsSize = 0
+	return nil
+}
+
+// shardPath returns the path for shard n of the repository described by
+// opts.RepositoryDescription, following zoekt's "<name>_v16.<NNNNN>.zoekt"
+// shard naming convention.
+func shardPath(opts Options, n int) string {
+	base := fmt.Sprintf("%s_v16.%05d.zoekt", url.QueryEscape(opts.RepositoryDescription.Name), n)
+	return filepath.Join(opts.IndexDir, base)
+}
+
+// writeShard hands docs off to the zoekt package's index writer and
+// persists the result at shardPath, writing to a temporary file first
+// so a crash mid-write never leaves a corrupt shard at the final path.
+func writeShard(opts Options, n int, docs []*zoekt.Document) error {
+	desc := opts.RepositoryDescription
+	ib, err := zoekt.NewIndexBuilder(&desc)
+	if err != nil {
+		return err
+	}
+	for _, d := range docs {
+		if err := ib.Add(*d); err != nil {
+			return fmt.Errorf("%s: %w", d.Name, err)
+		}
+	}
+
+	path := shardPath(opts, n)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if _, err := ib.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
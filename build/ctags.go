@@ -15,126 +15,263 @@
 package build
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
-	"os"
+	"io"
+	"log"
 	"os/exec"
-	"path/filepath"
+	"runtime"
+	"sync"
 	"time"
 
 	"github.com/xvandish/zoekt"
 	"github.com/xvandish/zoekt/ctags"
 )
 
-func runCTags(bin string, inputs map[string][]byte) ([]*ctags.Entry, error) {
-	const debug = false
-	if len(inputs) == 0 {
-		return nil, nil
+// ctagsRequestTimeout bounds how long a single generate-tags request may
+// take on a worker before we consider it hung. This mirrors the 60s budget
+// the old fork-per-batch implementation gave a whole chunk, but now applies
+// per file: one slow file delays only itself, not every other file sharing
+// its batch.
+const ctagsRequestTimeout = 60 * time.Second
+
+// defaultCTagsRecycleBytes is the fallback for Options.CTagsRecycleBytes
+// when it is left unset.
+const defaultCTagsRecycleBytes = 64 << 20
+
+// ctagsPools caches one process pool per ctags binary, since ctagsAddSymbols
+// is called repeatedly for the same bin across many documents/shards.
+var (
+	ctagsPoolsMu sync.Mutex
+	ctagsPools   = map[string]*ctagsPool{}
+)
+
+func getCTagsPool(bin string, opts Options) *ctagsPool {
+	ctagsPoolsMu.Lock()
+	defer ctagsPoolsMu.Unlock()
+
+	p, ok := ctagsPools[bin]
+	if !ok {
+		p = newCTagsPool(bin, opts)
+		ctagsPools[bin] = p
+	}
+	return p
+}
+
+// ctagsPool is a pool of long-lived "ctags --_interactive=default"
+// subprocesses. Workers are handed out via get/put; get blocks until a
+// worker is available or a new one can be spawned, bounding the number of
+// concurrent ctags processes to the pool's size.
+type ctagsPool struct {
+	bin          string
+	recycleBytes int64
+	// slots holds one entry per pool slot: a live *ctagsWorker, or nil to
+	// mean "the slot is free, spawn a new worker to fill it".
+	slots chan *ctagsWorker
+}
+
+func newCTagsPool(bin string, opts Options) *ctagsPool {
+	n := opts.Parallelism
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+
+	recycleBytes := opts.CTagsRecycleBytes
+	if recycleBytes <= 0 {
+		recycleBytes = defaultCTagsRecycleBytes
+	}
+
+	p := &ctagsPool{
+		bin:          bin,
+		recycleBytes: recycleBytes,
+		slots:        make(chan *ctagsWorker, n),
+	}
+	for i := 0; i < n; i++ {
+		p.slots <- nil
+	}
+	return p
+}
+
+// get returns a ready worker, starting a fresh process if the next free
+// slot hasn't been filled yet. On failure the slot is handed back so a
+// broken ctags binary doesn't permanently shrink the pool and wedge future
+// callers waiting on <-p.slots.
+func (p *ctagsPool) get() (*ctagsWorker, error) {
+	w := <-p.slots
+	if w != nil {
+		return w, nil
 	}
-	dir, err := os.MkdirTemp("", "ctags-input")
+	w, err := startCTagsWorker(p.bin)
 	if err != nil {
+		p.slots <- nil
 		return nil, err
 	}
-	if !debug {
-		defer os.RemoveAll(dir)
+	return w, nil
+}
+
+// put returns w to the pool, recycling it (killing the process and leaving
+// the slot to be refilled lazily) if it is broken or has processed enough
+// bytes to warrant bounding its memory use.
+func (p *ctagsPool) put(w *ctagsWorker) {
+	if w.broken || w.bytesProcessed >= p.recycleBytes {
+		w.kill()
+		p.slots <- nil
+		return
 	}
+	p.slots <- w
+}
 
-	// --sort shells out to sort(1).
-	args := []string{bin, "-n", "-f", "-", "--sort=no"}
+// ctagsWorker is a single "ctags --_interactive=default" subprocess
+// communicating over its stdin/stdout pipes using universal-ctags'
+// line-delimited JSON protocol.
+type ctagsWorker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+
+	bytesProcessed int64
+	// broken is set once the worker has misbehaved (timeout, protocol
+	// error, dead process) and should not be reused.
+	broken bool
+}
 
-	fileCount := 0
-	for n, c := range inputs {
-		if len(c) == 0 {
-			continue
-		}
+func startCTagsWorker(bin string) (*ctagsWorker, error) {
+	cmd := exec.Command(bin, "--_interactive=default", "--fields=*", "--output-format=json")
 
-		full := filepath.Join(dir, n)
-		if err := os.MkdirAll(filepath.Dir(full), 0o700); err != nil {
-			return nil, err
-		}
-		err := os.WriteFile(full, c, 0o600)
-		if err != nil {
-			return nil, err
-		}
-		args = append(args, n)
-		fileCount++
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
 	}
-	if fileCount == 0 {
-		return nil, nil
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
 	}
 
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Dir = dir
-
-	var errBuf, outBuf bytes.Buffer
-	cmd.Stderr = &errBuf
-	cmd.Stdout = &outBuf
-
 	if err := cmd.Start(); err != nil {
 		return nil, err
 	}
 
-	errChan := make(chan error, 1)
+	w := &ctagsWorker{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}
+
+	// universal-ctags greets interactive mode with a single {"_type":
+	// "program", ...} line before it will accept requests.
+	if _, err := w.readLineWithin(ctagsRequestTimeout); err != nil {
+		w.kill()
+		return nil, fmt.Errorf("starting ctags: %w", err)
+	}
+	return w, nil
+}
+
+func (w *ctagsWorker) kill() {
+	w.broken = true
+	if w.stdin != nil {
+		w.stdin.Close()
+	}
+	if w.cmd != nil && w.cmd.Process != nil {
+		_ = w.cmd.Process.Kill()
+		_ = w.cmd.Wait()
+	}
+}
+
+// readLineWithin reads a single newline-delimited line from the worker,
+// marking it broken (so put kills and replaces it) if nothing arrives
+// within timeout.
+func (w *ctagsWorker) readLineWithin(timeout time.Duration) ([]byte, error) {
+	type result struct {
+		line []byte
+		err  error
+	}
+	done := make(chan result, 1)
 	go func() {
-		err := cmd.Wait()
-		errChan <- err
+		l, err := w.stdout.ReadBytes('\n')
+		done <- result{l, err}
 	}()
-	timeout := time.After(60 * time.Second)
+
 	select {
-	case <-timeout:
-		_ = cmd.Process.Kill()
-		return nil, fmt.Errorf("timeout executing ctags")
-	case err := <-errChan:
-		if err != nil {
-			return nil, fmt.Errorf("exec(%s): %v, stderr: %s", cmd.Args, err, errBuf.String())
+	case <-time.After(timeout):
+		w.broken = true
+		return nil, fmt.Errorf("timeout reading from ctags")
+	case r := <-done:
+		if r.err != nil {
+			w.broken = true
+			return nil, r.err
 		}
+		return r.line, nil
+	}
+}
+
+type ctagsRequest struct {
+	Command  string `json:"command"`
+	Filename string `json:"filename"`
+	Size     int    `json:"size"`
+}
+
+// ctagsReply is the subset of universal-ctags' interactive JSON protocol we
+// care about: either a tag record ("_type":"tag") or the sentinel that
+// closes out a generate-tags request ("_type":"completed").
+type ctagsReply struct {
+	Type      string `json:"_type"`
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Line      int    `json:"line"`
+	Kind      string `json:"kind"`
+	Scope     string `json:"scope"`
+	ScopeKind string `json:"scopeKind"`
+}
+
+// request submits content for name to the worker and returns its tags. It
+// enforces ctagsRequestTimeout per file: a hung or misbehaving process is
+// killed and marked broken so the pool replaces it, and only this file's
+// request fails rather than an entire batch.
+func (w *ctagsWorker) request(name string, content []byte) ([]*ctags.Entry, error) {
+	req, err := json.Marshal(ctagsRequest{Command: "generate-tags", Filename: name, Size: len(content)})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.stdin.Write(append(req, '\n')); err != nil {
+		w.broken = true
+		return nil, err
+	}
+	if _, err := w.stdin.Write(content); err != nil {
+		w.broken = true
+		return nil, err
 	}
 
 	var entries []*ctags.Entry
-	for _, l := range bytes.Split(outBuf.Bytes(), []byte{'\n'}) {
-		if len(l) == 0 {
-			continue
-		}
-		e, err := ctags.Parse(string(l))
+	deadline := time.Now().Add(ctagsRequestTimeout)
+	for {
+		line, err := w.readLineWithin(time.Until(deadline))
 		if err != nil {
 			return nil, err
 		}
 
-		if len(e.Name) == 1 {
-			continue
+		var reply ctagsReply
+		if err := json.Unmarshal(line, &reply); err != nil {
+			w.broken = true
+			return nil, fmt.Errorf("parsing ctags reply for %s: %w", name, err)
 		}
-		entries = append(entries, e)
-	}
-	return entries, nil
-}
-
-func runCTagsChunked(bin string, in map[string][]byte) ([]*ctags.Entry, error) {
-	var res []*ctags.Entry
-
-	cur := map[string][]byte{}
-	sz := 0
-	for k, v := range in {
-		cur[k] = v
-		sz += len(k)
 
-		// 100k seems reasonable.
-		if sz > (100 << 10) {
-			r, err := runCTags(bin, cur)
-			if err != nil {
-				return nil, err
+		switch reply.Type {
+		case "completed":
+			w.bytesProcessed += int64(len(content))
+			return entries, nil
+		case "tag":
+			if len(reply.Name) == 1 {
+				continue
 			}
-			res = append(res, r...)
-
-			cur = map[string][]byte{}
-			sz = 0
+			entries = append(entries, &ctags.Entry{
+				Name:       reply.Name,
+				Path:       reply.Path,
+				Line:       reply.Line,
+				Kind:       reply.Kind,
+				Parent:     reply.Scope,
+				ParentKind: reply.ScopeKind,
+			})
 		}
 	}
-	r, err := runCTags(bin, cur)
-	if err != nil {
-		return nil, err
-	}
-	res = append(res, r...)
-	return res, nil
 }
 
 func ctagsAddSymbolsParser(todo []*zoekt.Document, parser ctags.Parser) error {
@@ -162,7 +299,19 @@ func ctagsAddSymbolsParser(todo []*zoekt.Document, parser ctags.Parser) error {
 	return nil
 }
 
-func ctagsAddSymbols(todo []*zoekt.Document, parser ctags.Parser, bin string) error {
+// ctagsAddSymbols annotates todo with symbol information. If parser is nil,
+// it is computed by submitting each file to a pool of persistent
+// universal-ctags processes (see ctagsPool) sized by bopts.Parallelism. A
+// file whose ctags request hangs or errors only loses its own symbols; it
+// does not abort the rest of todo.
+//
+// Before invoking ctags at all, each file's content-addressable key (see
+// SymbolCacheKey) is looked up in bopts.SymbolCache. A hit reuses the
+// symbols from the last time this exact (name, content) pair was indexed
+// and skips ctags entirely; this is the common case when incrementally
+// re-indexing an archive where only a handful of files actually changed.
+// A miss runs ctags as usual and stores the result for next time.
+func ctagsAddSymbols(todo []*zoekt.Document, parser ctags.Parser, bin string, bopts Options) error {
 	if parser != nil {
 		return ctagsAddSymbolsParser(todo, parser)
 	}
@@ -183,27 +332,97 @@ func ctagsAddSymbols(todo []*zoekt.Document, parser ctags.Parser, bin string) er
 		contents[t.Name] = t.Content
 	}
 
-	var err error
-	var entries []*ctags.Entry
-	entries, err = runCTagsChunked(bin, contents)
-	if err != nil {
-		return err
+	type job struct {
+		name    string
+		content []byte
+		key     string
 	}
 
-	fileTags := map[string][]*ctags.Entry{}
-	for _, e := range entries {
-		fileTags[e.Path] = append(fileTags[e.Path], e)
+	// Resolve cache hits up front so they never touch the ctags pool. The
+	// key computed here is reused below on a miss, rather than re-hashing
+	// the same content again after ctags runs.
+	jobs := make(chan job, len(contents))
+	numJobs := 0
+	for name, content := range contents {
+		// Namespacing by bin means switching ctags binaries (e.g. picking
+		// up a parser fix after an upgrade) can't serve stale symbols from
+		// a binary that's no longer in use.
+		key := bin + "\x00" + SymbolCacheKey(name, content)
+		if symbols, symMetaData, ok := bopts.SymbolCache.Get(key); ok {
+			idx := pathIndices[name]
+			todo[idx].Symbols = symbols
+			todo[idx].SymbolsMetaData = symMetaData
+			continue
+		}
+		jobs <- job{name: name, content: content, key: key}
+		numJobs++
+	}
+	close(jobs)
+	if numJobs == 0 {
+		return nil
 	}
 
-	for k, tags := range fileTags {
-		symOffsets, symMetaData, err := tagsToSections(contents[k], tags)
-		if err != nil {
-			return fmt.Errorf("%s: %v", k, err)
-		}
-		todo[pathIndices[k]].Symbols = symOffsets
-		todo[pathIndices[k]].SymbolsMetaData = symMetaData
+	pool := getCTagsPool(bin, bopts)
+
+	workers := bopts.Parallelism
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
 	}
-	return nil
+	if workers > numJobs {
+		workers = numJobs
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				w, err := pool.get()
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("starting ctags worker: %w", err)
+					}
+					mu.Unlock()
+					continue
+				}
+
+				entries, reqErr := w.request(j.name, j.content)
+				pool.put(w)
+				if reqErr != nil {
+					log.Printf("ctags: %s: %v", j.name, reqErr)
+					continue
+				}
+
+				symOffsets, symMetaData, err := tagsToSections(j.content, entries)
+				if err != nil {
+					log.Printf("ctags: %s: %v", j.name, err)
+					continue
+				}
+				bopts.SymbolCache.Put(j.key, symOffsets, symMetaData)
+
+				mu.Lock()
+				idx := pathIndices[j.name]
+				todo[idx].Symbols = symOffsets
+				todo[idx].SymbolsMetaData = symMetaData
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// A failure to persist the cache sidecar shouldn't fail a build that
+	// otherwise succeeded; the next run just gets fewer cache hits.
+	if err := bopts.SymbolCache.Save(); err != nil {
+		log.Printf("ctags: saving symbol cache: %v", err)
+	}
+
+	return firstErr
 }
 
 // overlaps finds the proper position to insert a zoekt.DocumentSection with
@@ -0,0 +1,104 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/xvandish/zoekt"
+	"github.com/xvandish/zoekt/ctags"
+)
+
+// DefaultDir is where shards are written to if Options.IndexDir is unset.
+var DefaultDir = filepath.Join(os.Getenv("HOME"), ".zoekt")
+
+// Options are the configuration knobs for building (or incrementally
+// updating) the shards for a single repository.
+type Options struct {
+	// Parallelism bounds how many files are indexed (and how many ctags
+	// worker processes run) concurrently. Defaults to GOMAXPROCS.
+	Parallelism int
+
+	// SizeMax is the maximum size of a file that is indexed in full.
+	SizeMax int
+
+	// ShardMax is the maximum corpus size, in bytes of file content, held
+	// in a single shard before it is flushed to disk.
+	ShardMax int
+
+	// IndexDir is the directory shards (and sidecars such as SymbolCache's
+	// backing file) are written to.
+	IndexDir string
+
+	// LargeFiles is a list of glob patterns (relative to the repository
+	// root) that are indexed even though they exceed SizeMax. Patterns
+	// are applied in order, gitignore-style: a pattern prefixed with "!"
+	// excludes the match instead of including it, and a later pattern in
+	// the list overrides an earlier one. A literal leading "!" in a
+	// filename can be matched by escaping it as "\\!".
+	LargeFiles []string
+
+	// RepositoryDescription describes the repository being indexed.
+	RepositoryDescription zoekt.Repository
+
+	// CTagsPath is the path to the universal-ctags binary used to
+	// populate symbol information when Parser is nil.
+	CTagsPath string
+
+	// Parser, if set, is used in-process instead of shelling out to
+	// CTagsPath.
+	Parser ctags.Parser
+
+	// CTagsRecycleBytes is how many bytes of file content a ctags worker
+	// processes before it is killed and replaced, bounding the memory a
+	// long-lived ctags process can accumulate. Defaults to 64MiB.
+	CTagsRecycleBytes int64
+
+	// SymbolCache, if set, caches per-file symbol information across
+	// incremental builds so unchanged files skip ctags entirely. See
+	// SymbolCacheKey.
+	SymbolCache *SymbolCache
+}
+
+// SetDefaults fills in zero-valued fields with sane defaults.
+func (o *Options) SetDefaults() {
+	if o.Parallelism == 0 {
+		o.Parallelism = runtime.GOMAXPROCS(0)
+	}
+	if o.SizeMax == 0 {
+		o.SizeMax = 1 << 20
+	}
+	if o.ShardMax == 0 {
+		o.ShardMax = 100 << 20
+	}
+	if o.IndexDir == "" {
+		o.IndexDir = DefaultDir
+	}
+	if o.CTagsPath == "" {
+		o.CTagsPath = "ctags"
+	}
+}
+
+// IncrementalSkipIndexing reports whether a fresh build can be skipped
+// entirely because an up-to-date shard already exists for
+// RepositoryDescription. This tree doesn't carry the shard TOC reader
+// needed to compare an existing shard's version/hash against the current
+// one, so it conservatively always returns false: callers always rebuild,
+// the symbol cache is what provides the fast path when doing so.
+func (o *Options) IncrementalSkipIndexing() bool {
+	return false
+}
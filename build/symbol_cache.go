@@ -0,0 +1,136 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/xvandish/zoekt"
+)
+
+// SymbolCacheKey returns the content-addressable cache key for a file: the
+// hex SHA-256 of its name, a NUL separator, and its content, in the spirit
+// of tarsum's per-entry hashing. Two incremental builds over archives that
+// differ only in a handful of files produce identical keys for everything
+// that didn't change.
+func SymbolCacheKey(name string, content []byte) string {
+	h := sha256.New()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type symbolCacheEntry struct {
+	Symbols         []zoekt.DocumentSection
+	SymbolsMetaData []*zoekt.Symbol
+}
+
+// SymbolCache is a sidecar file persisted next to a shard that maps
+// SymbolCacheKey(name, content) to the symbols ctags previously extracted
+// for that exact file content. Builders consult it to skip re-running
+// ctags on files that are byte-for-byte unchanged from the last build,
+// which is the common case when incrementally re-indexing an archive that
+// only had a handful of files touched since its last snapshot.
+type SymbolCache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]symbolCacheEntry
+	dirty   bool
+}
+
+// OpenSymbolCache loads the cache sidecar at path, starting a fresh, empty
+// cache if it doesn't exist yet or can't be decoded.
+func OpenSymbolCache(path string) (*SymbolCache, error) {
+	c := &SymbolCache{path: path, entries: map[string]symbolCacheEntry{}}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := gob.NewDecoder(f).Decode(&c.entries); err != nil {
+		// A corrupt or incompatible sidecar shouldn't block indexing: fall
+		// back to a cold cache and let Save overwrite it.
+		return &SymbolCache{path: path, entries: map[string]symbolCacheEntry{}}, nil
+	}
+	return c, nil
+}
+
+// Get returns the symbols cached for key, if present. A nil receiver is
+// treated as an always-empty cache, so callers can pass a *SymbolCache that
+// may or may not have been configured without a nil check at every call
+// site.
+func (c *SymbolCache) Get(key string) (symbols []zoekt.DocumentSection, symbolsMetaData []*zoekt.Symbol, ok bool) {
+	if c == nil {
+		return nil, nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	return e.Symbols, e.SymbolsMetaData, ok
+}
+
+// Put records the symbols ctags produced for key.
+func (c *SymbolCache) Put(key string, symbols []zoekt.DocumentSection, symbolsMetaData []*zoekt.Symbol) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = symbolCacheEntry{Symbols: symbols, SymbolsMetaData: symbolsMetaData}
+	c.dirty = true
+}
+
+// Save persists the cache to its sidecar path, if it has unsaved changes.
+func (c *SymbolCache) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(c.entries); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
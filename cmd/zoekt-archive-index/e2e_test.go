@@ -3,17 +3,25 @@ package main
 import (
 	"archive/tar"
 	"archive/zip"
+	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/xvandish/zoekt"
 	"github.com/xvandish/zoekt/build"
 	"github.com/xvandish/zoekt/query"
@@ -55,6 +63,21 @@ func writeArchive(w io.Writer, format string, files map[string]string) (err erro
 		format = "tar"
 	}
 
+	if format == "tar.zst" {
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err2 := zw.Close()
+			if err == nil {
+				err = err2
+			}
+		}()
+		w = zw
+		format = "tar"
+	}
+
 	if format != "tar" {
 		return errors.New("expected tar")
 	}
@@ -87,7 +110,7 @@ func writeArchive(w io.Writer, format string, files map[string]string) (err erro
 // -incremental=true option changing the options between indexes and ensuring
 // the results change as expected.
 func TestIndexIncrementally(t *testing.T) {
-	for _, format := range []string{"tar", "tgz", "zip"} {
+	for _, format := range []string{"tar", "tgz", "zip", "tar.zst"} {
 		t.Run(format, func(t *testing.T) {
 			testIndexIncrementally(t, format)
 		})
@@ -189,3 +212,296 @@ func testIndexIncrementally(t *testing.T, format string) {
 		}
 	}
 }
+
+// gzipMember gzip-compresses body as a standalone gzip member (no
+// multistream concatenation with whatever comes before or after it).
+func gzipMember(body []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(body)
+	gw.Close()
+	return buf.Bytes()
+}
+
+// stargzFooter builds the 51-byte eStargz footer whose FEXTRA "SG"
+// subfield records tocOffset as 16 hex digits, padding the rest of the
+// footer's (otherwise-empty) gzip member out to stargzFooterSize.
+func stargzFooter(tocOffset int64) []byte {
+	footer := make([]byte, stargzFooterSize)
+	footer[0], footer[1], footer[2] = 0x1f, 0x8b, 8 // ID1, ID2, CM=deflate
+	footer[3] = 0x04                                // FLG: FEXTRA
+	extra := []byte{20, 0, 'S', 'G', 16, 0}         // XLEN=20 (SI1+SI2+SLEN+16 data bytes), SI1SI2="SG", SLEN=16
+	copy(footer[10:], extra)
+	copy(footer[16:], []byte(fmt.Sprintf("%016x", tocOffset)))
+	return footer
+}
+
+// buildEStargz concatenates one gzip member per file, a gzip member
+// holding the JSON TOC, and a trailing footer member, mirroring the
+// layout tryFetchStargzTOC/indexSeekableTOC expect to find at the tail of
+// a range-fetchable eStargz archive.
+func buildEStargz(files map[string]string) []byte {
+	var buf bytes.Buffer
+	toc := seekableTOC{Version: 1}
+	for name, body := range files {
+		toc.Entries = append(toc.Entries, seekableEntry{
+			Name:   name,
+			Type:   "reg",
+			Size:   int64(len(body)),
+			Offset: int64(buf.Len()),
+		})
+		buf.Write(gzipMember([]byte(body)))
+	}
+
+	tocOffset := int64(buf.Len())
+	tocJSON, _ := json.Marshal(toc)
+	buf.Write(gzipMember(tocJSON))
+	buf.Write(stargzFooter(tocOffset))
+
+	return buf.Bytes()
+}
+
+// rangeServer serves data over HTTP, honoring HEAD and Range: bytes=a-b
+// requests the way a real object store would, so tryFetchStargzTOC and
+// tryFetchZstdChunkedTOC's range-fetch fast path can be exercised end to
+// end without a real remote archive host.
+func rangeServer(t *testing.T, data []byte) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		start, end := int64(0), int64(len(data)-1)
+		if rng := r.Header.Get("Range"); rng != "" {
+			var s, e int64
+			if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &s, &e); err == nil {
+				start, end = s, e
+				w.WriteHeader(http.StatusPartialContent)
+			}
+		}
+		if end >= int64(len(data)) {
+			end = int64(len(data)) - 1
+		}
+		w.Write(data[start : end+1])
+	}))
+}
+
+// TestIndexSeekableTOCEStargz indexes an eStargz archive served over HTTP
+// by its range-fetch fast path: only the TOC and the files that survive
+// opts/bopts filtering are ever fetched, and the content indexed for a.txt
+// must hold only its own gzip member, not the entries, TOC or footer
+// members that follow it in the archive.
+func TestIndexSeekableTOCEStargz(t *testing.T) {
+	files := map[string]string{
+		"a.txt": strings.Repeat("alpha ", 50),
+		"b.txt": strings.Repeat("bravo ", 50),
+	}
+	srv := rangeServer(t, buildEStargz(files))
+	defer srv.Close()
+
+	toc, tocOffset, ok := tryFetchStargzTOC(srv.URL)
+	if !ok {
+		t.Fatalf("tryFetchStargzTOC(%s): not ok", srv.URL)
+	}
+	if len(toc.Entries) != len(files) {
+		t.Fatalf("got %d TOC entries, want %d", len(toc.Entries), len(files))
+	}
+
+	indexDir := t.TempDir()
+	bopts := build.Options{IndexDir: indexDir}
+	opts := Options{
+		Name:   "repo",
+		Branch: "master",
+		Commit: "cccccccccccccccccccccccccccccccccccccccc",
+	}
+	bopts.SetDefaults()
+
+	matcher, err := newIncludeExcludeMatcher("", "")
+	if err != nil {
+		t.Fatalf("newIncludeExcludeMatcher: %v", err)
+	}
+	if err := indexSeekableTOC(opts, bopts, toc, tocOffset, matcher, decompressGzipMember); err != nil {
+		t.Fatalf("indexSeekableTOC: %v", err)
+	}
+
+	ss, err := shards.NewDirectorySearcher(indexDir)
+	if err != nil {
+		t.Fatalf("NewDirectorySearcher(%s): %v", indexDir, err)
+	}
+	defer ss.Close()
+
+	q, err := query.Parse("alpha")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	result, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{Whole: true})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(result.Files) != 1 {
+		t.Fatalf("got %d files, want 1", len(result.Files))
+	}
+	if got := string(result.Files[0].Content); strings.Contains(got, "bravo") || strings.Contains(got, "stargz.index.json") {
+		t.Errorf("content for a.txt leaked trailing members: %q", got)
+	}
+}
+
+// TestParseStargzFooter is a regression test for the FEXTRA subfield-data
+// offset: the "SG" subfield payload starts at byte 16 of the footer, not
+// byte 12.
+func TestParseStargzFooter(t *testing.T) {
+	want := int64(123456)
+	got, err := parseStargzFooter(stargzFooter(want))
+	if err != nil {
+		t.Fatalf("parseStargzFooter: %v", err)
+	}
+	if got != want {
+		t.Errorf("parseStargzFooter: got offset %d, want %d", got, want)
+	}
+}
+
+// TestDecompressGzipMemberStopsAtMemberBoundary is a regression test for
+// the multistream bug: decompressGzipMember must decode only the first
+// gzip member in b, even when further members follow.
+func TestDecompressGzipMemberStopsAtMemberBoundary(t *testing.T) {
+	var b bytes.Buffer
+	b.Write(gzipMember([]byte("first")))
+	b.Write(gzipMember([]byte("second")))
+
+	got, err := decompressGzipMember(b.Bytes())
+	if err != nil {
+		t.Fatalf("decompressGzipMember: %v", err)
+	}
+	if string(got) != "first" {
+		t.Errorf("decompressGzipMember: got %q, want %q", got, "first")
+	}
+}
+
+// zstdChunkedFooter builds the 16-byte zstd:chunked footer that records
+// manifestOffset and the byte length of the skippable frame's payload.
+func zstdChunkedFooter(manifestOffset int64, payloadLen uint32) []byte {
+	footer := make([]byte, zstdChunkedFooterSize)
+	binary.BigEndian.PutUint64(footer[:8], uint64(manifestOffset))
+	binary.LittleEndian.PutUint32(footer[8:12], zstdSkippableMagicMin)
+	binary.LittleEndian.PutUint32(footer[12:16], payloadLen)
+	return footer
+}
+
+func TestParseZstdChunkedFooter(t *testing.T) {
+	wantOffset, wantLen := int64(777), uint32(42)
+	gotOffset, gotLen, err := parseZstdChunkedFooter(zstdChunkedFooter(wantOffset, wantLen))
+	if err != nil {
+		t.Fatalf("parseZstdChunkedFooter: %v", err)
+	}
+	if gotOffset != wantOffset || gotLen != wantLen {
+		t.Errorf("parseZstdChunkedFooter: got (%d, %d), want (%d, %d)", gotOffset, gotLen, wantOffset, wantLen)
+	}
+}
+
+// TestIndexSeekableTOCZstdChunked mirrors TestIndexSeekableTOCEStargz for
+// the zstd:chunked manifest layout, exercising tryFetchZstdChunkedTOC and
+// decompressZstdMember's independent-frame decoding.
+func TestIndexSeekableTOCZstdChunked(t *testing.T) {
+	files := map[string]string{
+		"a.txt": strings.Repeat("alpha ", 50),
+		"b.txt": strings.Repeat("bravo ", 50),
+	}
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("zstd.NewWriter: %v", err)
+	}
+	defer enc.Close()
+
+	var buf bytes.Buffer
+	toc := seekableTOC{Version: 1}
+	for name, body := range files {
+		toc.Entries = append(toc.Entries, seekableEntry{
+			Name:   name,
+			Type:   "reg",
+			Size:   int64(len(body)),
+			Offset: int64(buf.Len()),
+		})
+		buf.Write(enc.EncodeAll([]byte(body), nil))
+	}
+
+	manifestOffset := int64(buf.Len())
+	tocJSON, _ := json.Marshal(toc)
+	manifestHeader := make([]byte, 8)
+	binary.LittleEndian.PutUint32(manifestHeader[:4], zstdSkippableMagicMin)
+	binary.LittleEndian.PutUint32(manifestHeader[4:], uint32(len(tocJSON)))
+	buf.Write(manifestHeader)
+	buf.Write(tocJSON)
+	buf.Write(zstdChunkedFooter(manifestOffset, uint32(len(tocJSON))))
+
+	srv := rangeServer(t, buf.Bytes())
+	defer srv.Close()
+
+	gotTOC, gotManifestOffset, ok := tryFetchZstdChunkedTOC(srv.URL)
+	if !ok {
+		t.Fatalf("tryFetchZstdChunkedTOC(%s): not ok", srv.URL)
+	}
+	if len(gotTOC.Entries) != len(files) {
+		t.Fatalf("got %d TOC entries, want %d", len(gotTOC.Entries), len(files))
+	}
+
+	indexDir := t.TempDir()
+	bopts := build.Options{IndexDir: indexDir}
+	bopts.SetDefaults()
+	opts := Options{Name: "repo", Branch: "master", Commit: "cccccccccccccccccccccccccccccccccccccccc"}
+
+	matcher, err := newIncludeExcludeMatcher("", "")
+	if err != nil {
+		t.Fatalf("newIncludeExcludeMatcher: %v", err)
+	}
+	if err := indexSeekableTOC(opts, bopts, gotTOC, gotManifestOffset, matcher, decompressZstdMember); err != nil {
+		t.Fatalf("indexSeekableTOC: %v", err)
+	}
+
+	ss, err := shards.NewDirectorySearcher(indexDir)
+	if err != nil {
+		t.Fatalf("NewDirectorySearcher(%s): %v", indexDir, err)
+	}
+	defer ss.Close()
+
+	q, err := query.Parse("bravo")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	result, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(result.Files) != 1 {
+		t.Fatalf("got %d files, want 1", len(result.Files))
+	}
+}
+
+// TestSymbolCacheSkipsUnchangedFiles exercises the cache hit path
+// ctagsAddSymbols relies on to skip re-running ctags on a file whose
+// content is byte-for-byte unchanged from a previous incremental build.
+func TestSymbolCacheSkipsUnchangedFiles(t *testing.T) {
+	cache, err := build.OpenSymbolCache(filepath.Join(t.TempDir(), "repo.symcache"))
+	if err != nil {
+		t.Fatalf("OpenSymbolCache: %v", err)
+	}
+
+	key := build.SymbolCacheKey("a.txt", []byte("content"))
+	if _, _, ok := cache.Get(key); ok {
+		t.Fatalf("Get: unexpected hit before Put")
+	}
+
+	symbols := []zoekt.DocumentSection{{Start: 0, End: 3}}
+	cache.Put(key, symbols, nil)
+
+	gotSymbols, _, ok := cache.Get(key)
+	if !ok {
+		t.Fatalf("Get: expected hit after Put")
+	}
+	if len(gotSymbols) != len(symbols) {
+		t.Errorf("Get: got %d symbols, want %d", len(gotSymbols), len(symbols))
+	}
+}
@@ -0,0 +1,754 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command zoekt-archive-index indexes the contents of a single archive
+// (tar, tgz, tar.zst or zip) as if it were a repository.
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/xvandish/zoekt"
+	"github.com/xvandish/zoekt/build"
+)
+
+// zstdZipMethod is the method ID the zip "APPNOTE" addendum assigns to
+// zstd, used by zip archives whose entries are compressed with zstd
+// instead of the usual deflate.
+const zstdZipMethod = 93
+
+func init() {
+	zip.RegisterDecompressor(zstdZipMethod, func(r io.Reader) io.ReadCloser {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return io.NopCloser(errReader{err})
+		}
+		return zr.IOReadCloser()
+	})
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// stringListFlag implements flag.Value for a flag that may be repeated to
+// build up a list, e.g. -large_file 'vendor/*' -large_file '!vendor/*.go'.
+type stringListFlag []string
+
+func (f *stringListFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringListFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// Options are the options that are specific to indexing an archive.
+type Options struct {
+	Incremental bool
+	Archive     string
+	Name        string
+	RepoURL     string
+	Branch      string
+	Commit      string
+	Strip       int
+
+	Include string
+	Exclude string
+}
+
+func (o *Options) SetDefaults() {
+	if o.Name == "" && o.RepoURL != "" {
+		o.Name = o.RepoURL
+	}
+}
+
+func main() {
+	var (
+		incremental = flag.Bool("incremental", true, "reuse per-file ctags symbols cached by the previous build; the archive itself is always re-indexed")
+		archive     = flag.String("archive", "", "path to an archive (tar, tgz, tar.zst or zip), or an http(s):// URL pointing at one")
+		name        = flag.String("name", "", "the repository name")
+		repoURL     = flag.String("url", "", "repository URL")
+		branch      = flag.String("branch", "master", "the branch name")
+		commit      = flag.String("commit", "", "the commit sha of the archive")
+		strip       = flag.Int("strip", 0, "strip this many leading path components from filenames in the archive")
+		include     = flag.String("include", "", "only index files matching this glob")
+		exclude     = flag.String("exclude", "", "don't index files matching this glob")
+	)
+
+	var sizeMax = flag.Int("file_limit", 1<<20, "maximum file size")
+	var shardLimit = flag.Int("shard_limit", 100<<20, "maximum corpus size for a shard")
+	var parallelism = flag.Int("parallelism", 4, "maximum number of parallel indexing processes")
+	var indexDir = flag.String("index", build.DefaultDir, "directory for shard files")
+	var ctagsPath = flag.String("ctags_path", "", "path to the universal-ctags binary (defaults to ctags on $PATH)")
+	var ctagsRecycleBytes = flag.Int64("ctags_recycle_bytes", 0, "bytes of file content a ctags worker processes before it is killed and replaced (0 uses the package default)")
+	var largeFiles stringListFlag
+	flag.Var(&largeFiles, "large_file", "a glob pattern for files to index even though they exceed --file_limit; may be repeated. Prefix with \"!\" to exclude a match instead")
+	flag.Parse()
+
+	if *archive == "" {
+		log.Fatal("must set --archive")
+	}
+	if *commit == "" {
+		log.Fatal("must set --commit")
+	}
+
+	opts := Options{
+		Incremental: *incremental,
+		Archive:     *archive,
+		Name:        *name,
+		RepoURL:     *repoURL,
+		Branch:      *branch,
+		Commit:      *commit,
+		Strip:       *strip,
+		Include:     *include,
+		Exclude:     *exclude,
+	}
+	opts.SetDefaults()
+
+	bopts := build.Options{
+		Parallelism:       *parallelism,
+		SizeMax:           *sizeMax,
+		ShardMax:          *shardLimit,
+		IndexDir:          *indexDir,
+		CTagsPath:         *ctagsPath,
+		CTagsRecycleBytes: *ctagsRecycleBytes,
+		LargeFiles:        largeFiles,
+	}
+	bopts.SetDefaults()
+	bopts.RepositoryDescription.Name = opts.Name
+	bopts.RepositoryDescription.URL = opts.RepoURL
+
+	if err := do(opts, bopts); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// isHTTPURL reports whether archive refers to a remote archive that should
+// be fetched over HTTP(S) rather than read from the local filesystem.
+func isHTTPURL(archive string) bool {
+	return strings.HasPrefix(archive, "http://") || strings.HasPrefix(archive, "https://")
+}
+
+// symbolCachePath returns where the per-file symbol cache sidecar for this
+// repository's shard lives.
+func symbolCachePath(bopts build.Options) string {
+	return filepath.Join(bopts.IndexDir, bopts.RepositoryDescription.Name+".symcache")
+}
+
+// do indexes opts.Archive into a shard using bopts.
+//
+// When opts.Archive is an http(s) URL served by an origin that advertises
+// Accept-Ranges: bytes and the archive carries an appended eStargz-style
+// table of contents (or a seekable zstd manifest, see
+// tryFetchZstdChunkedTOC), do avoids downloading the whole archive: it fetches
+// just the TOC, filters entries locally, and range-fetches only the
+// surviving files. Everything else falls back to a single streaming GET or
+// a local file read.
+//
+// When opts.Incremental is set, do also opens the per-file symbol cache
+// sidecar for this repository (see build.SymbolCache) so that files whose
+// content is unchanged from the last build skip ctags entirely.
+func do(opts Options, bopts build.Options) error {
+	if opts.Incremental && bopts.IncrementalSkipIndexing() {
+		return nil
+	}
+
+	if opts.Incremental {
+		cache, err := build.OpenSymbolCache(symbolCachePath(bopts))
+		if err != nil {
+			return err
+		}
+		bopts.SymbolCache = cache
+	}
+
+	var matcher func(name string) bool
+	if matcher2, err := newIncludeExcludeMatcher(opts.Include, opts.Exclude); err != nil {
+		return err
+	} else {
+		matcher = matcher2
+	}
+
+	if isHTTPURL(opts.Archive) {
+		if toc, tocOffset, ok := tryFetchStargzTOC(opts.Archive); ok {
+			log.Printf("found eStargz TOC with %d entries at offset %d in %s, using seekable fetch", len(toc.Entries), tocOffset, opts.Archive)
+			return indexSeekableTOC(opts, bopts, toc, tocOffset, matcher, decompressGzipMember)
+		}
+		if toc, manifestOffset, ok := tryFetchZstdChunkedTOC(opts.Archive); ok {
+			log.Printf("found seekable zstd manifest with %d entries at offset %d in %s, using seekable fetch", len(toc.Entries), manifestOffset, opts.Archive)
+			return indexSeekableTOC(opts, bopts, toc, manifestOffset, matcher, decompressZstdMember)
+		}
+		log.Printf("no seekable TOC found for %s, falling back to streaming download", opts.Archive)
+	}
+
+	r, closer, err := openArchiveStream(opts.Archive)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	return indexStream(opts, bopts, r, matcher)
+}
+
+// openArchiveStream returns a reader over the raw bytes of opts.Archive,
+// either a local file or the body of an HTTP GET.
+func openArchiveStream(archive string) (io.Reader, io.Closer, error) {
+	if isHTTPURL(archive) {
+		resp, err := http.Get(archive)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, nil, fmt.Errorf("GET %s: %s", archive, resp.Status)
+		}
+		return resp.Body, resp.Body, nil
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f, nil
+}
+
+// zipMagic prefixes the handful of local/central-directory signatures a zip
+// stream may start with: a regular local file header, or the end-of-central-
+// directory record for an empty archive.
+var zipMagic = [][]byte{
+	{'P', 'K', 0x03, 0x04},
+	{'P', 'K', 0x05, 0x06},
+}
+
+// indexStream indexes an archive read in full from r, detecting tar, tgz,
+// tar.zst and zip by sniffing the leading bytes of the stream rather than
+// trusting opts.Archive's extension, since archive may be an extensionless
+// temp file or a URL with no path suffix at all.
+func indexStream(opts Options, bopts build.Options, r io.Reader, matcher func(string) bool) error {
+	builder, err := build.NewBuilder(bopts)
+	if err != nil {
+		return err
+	}
+	defer builder.Finish()
+
+	add := func(name string, size int64, body func() ([]byte, error)) error {
+		if !shouldIndex(name, size, bopts, matcher) {
+			return nil
+		}
+		content, err := body()
+		if err != nil {
+			return err
+		}
+		return builder.Add(zoekt.Document{
+			Name:     stripComponents(name, opts.Strip),
+			Content:  content,
+			Branches: []string{opts.Branch},
+		})
+	}
+
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	switch {
+	case len(magic) >= 2 && magic[0] == 'P' && magic[1] == 'K':
+		for _, m := range zipMagic {
+			if bytes.HasPrefix(magic, m) {
+				return indexZipStream(br, add)
+			}
+		}
+		return fmt.Errorf("unrecognized zip signature %x", magic)
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		return indexTarStream(gr, add)
+	case bytes.HasPrefix(magic, []byte{0xFD, 0x2F, 0xB5, 0x28}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		return indexTarStream(zr.IOReadCloser(), add)
+	default:
+		return indexTarStream(br, add)
+	}
+}
+
+func indexTarStream(r io.Reader, add func(name string, size int64, body func() ([]byte, error)) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := add(hdr.Name, hdr.Size, func() ([]byte, error) {
+			return io.ReadAll(tr)
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// zip.Reader needs to seek, so indexStream must buffer a zip archive read
+// over HTTP or from an archive/zip incompatible reader. Since zip archives
+// only carry their central directory at the end of the file, there's no
+// way around reading it fully first.
+func indexZipStream(r io.Reader, add func(name string, size int64, body func() ([]byte, error)) error) error {
+	tmp, err := os.CreateTemp("", "zoekt-archive-index-zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		f := f
+		if err := add(f.Name, int64(f.UncompressedSize64), func() ([]byte, error) {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return io.ReadAll(rc)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stripComponents(name string, strip int) string {
+	for i := 0; i < strip; i++ {
+		if idx := strings.IndexByte(name, '/'); idx >= 0 {
+			name = name[idx+1:]
+		} else {
+			break
+		}
+	}
+	return name
+}
+
+func newIncludeExcludeMatcher(include, exclude string) (func(name string) bool, error) {
+	return func(name string) bool {
+		if include != "" {
+			if ok, err := path.Match(include, name); err != nil || !ok {
+				return false
+			}
+		}
+		if exclude != "" {
+			if ok, err := path.Match(exclude, name); err == nil && ok {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// shouldIndex applies the include/exclude matcher together with the
+// SizeMax/LargeFiles filters from bopts. LargeFiles is a list of globs
+// (relative to the archive root) that are indexed even though they exceed
+// SizeMax. Patterns are applied in order, gitignore-style: a later match
+// overrides an earlier one, so a "!pat" negation can be undone by a more
+// specific pattern appearing after it in the list.
+func shouldIndex(name string, size int64, bopts build.Options, matcher func(string) bool) bool {
+	if !matcher(name) {
+		return false
+	}
+	if size <= int64(bopts.SizeMax) {
+		return true
+	}
+
+	included := false
+	for _, pat := range bopts.LargeFiles {
+		neg := strings.HasPrefix(pat, "!")
+		p := pat
+		switch {
+		case strings.HasPrefix(pat, "\\!"):
+			// Escaped: match a literal leading "!" in the filename rather
+			// than treating it as a negation. Strip only the backslash.
+			p = strings.TrimPrefix(pat, "\\")
+		case neg:
+			p = strings.TrimPrefix(pat, "!")
+		}
+		if ok, err := filepath.Match(p, name); err != nil || !ok {
+			continue
+		}
+		included = !neg
+	}
+	return included
+}
+
+// --- eStargz-style seekable TOC support ---
+//
+// An eStargz archive is a gzip stream where every file is compressed as
+// its own independent gzip member, followed by a final member containing
+// a JSON table of contents (stargz.index.json), and a small fixed-size
+// footer that records the byte offset of that final member. When the
+// origin supports range requests we can fetch the footer and TOC alone,
+// decide locally which files we actually want, and then range-fetch just
+// those files' gzip members.
+
+const (
+	// stargzFooterSize is the size of the trailing footer member that
+	// encodes the offset of the TOC. It is itself a valid (empty) gzip
+	// member, so readers that don't understand the format can ignore it.
+	stargzFooterSize = 51
+	// stargzFooterFetchSize is how much of the tail of the archive we
+	// fetch in one go: enough for the footer, and a reasonable chance of
+	// also covering a small TOC so we don't always need a second round
+	// trip.
+	stargzFooterFetchSize = 64 << 10
+)
+
+type seekableTOC struct {
+	Version int             `json:"version"`
+	Entries []seekableEntry `json:"entries"`
+}
+
+type seekableEntry struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"` // "reg", "dir", "symlink", ...
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"` // byte offset of this entry's gzip member
+}
+
+// tryFetchStargzTOC checks whether url is range-fetchable and, if so,
+// whether it carries an eStargz TOC. It returns ok=false whenever the fast
+// path isn't available, in which case the caller should fall back to a
+// plain streaming GET.
+func tryFetchStargzTOC(url string) (toc *seekableTOC, tocOffset int64, ok bool) {
+	size, rangesOK := headAcceptsRanges(url)
+	if !rangesOK || size < stargzFooterSize {
+		return nil, 0, false
+	}
+
+	start := size - stargzFooterFetchSize
+	if start < 0 {
+		start = 0
+	}
+	tail, err := fetchRange(url, start, size-1)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	footer := tail[len(tail)-stargzFooterSize:]
+	off, err := parseStargzFooter(footer)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	var tocBytes []byte
+	if off >= start {
+		tocBytes = tail[off-start : len(tail)-stargzFooterSize]
+	} else {
+		tocBytes, err = fetchRange(url, off, size-stargzFooterSize-1)
+		if err != nil {
+			return nil, 0, false
+		}
+	}
+
+	raw, err := decompressGzipMember(tocBytes)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	toc = &seekableTOC{}
+	if err := json.Unmarshal(raw, toc); err != nil {
+		return nil, 0, false
+	}
+	return toc, off, true
+}
+
+// parseStargzFooter extracts the offset of the TOC gzip member from an
+// eStargz footer: a gzip header with the FEXTRA flag set, carrying a "SG"
+// subfield whose payload is the 16-hex-digit TOC offset.
+func parseStargzFooter(footer []byte) (int64, error) {
+	if len(footer) != stargzFooterSize {
+		return 0, fmt.Errorf("invalid footer length %d", len(footer))
+	}
+	// byte 3 is FLG; FEXTRA is bit 2. The extra field starts at byte 10:
+	// XLEN(2) SI1 SI2 SLEN(2) subfield-data. subfield-data itself only
+	// starts after SI1/SI2/SLEN, i.e. at byte 16.
+	if footer[3]&0x04 == 0 {
+		return 0, fmt.Errorf("footer has no extra field")
+	}
+	extra := footer[16:]
+	if len(extra) < 16 {
+		return 0, fmt.Errorf("extra field too short")
+	}
+	off, err := strconv.ParseInt(string(extra[:16]), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing TOC offset: %w", err)
+	}
+	return off, nil
+}
+
+// headAcceptsRanges issues a HEAD request and reports the content length
+// and whether the origin advertises Accept-Ranges: bytes.
+func headAcceptsRanges(url string) (size int64, ok bool) {
+	resp, err := http.Head(url)
+	if err != nil {
+		return 0, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, false
+	}
+	if !strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes") {
+		return 0, false
+	}
+	return resp.ContentLength, resp.ContentLength > 0
+}
+
+// fetchRange fetches the inclusive byte range [start, end] of url.
+func fetchRange(url string, start, end int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("range GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// decompressGzipMember decodes exactly one gzip member from b. Multistream
+// decoding is disabled, so any further gzip members in b after the first
+// are ignored: without this, gzip.Reader would keep decoding every
+// following member and concatenate their content into the result.
+func decompressGzipMember(b []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	gr.Multistream(false)
+	defer gr.Close()
+	return io.ReadAll(gr)
+}
+
+// indexSeekableTOC builds a shard by filtering toc.Entries locally against
+// opts/bopts and then range-fetching only the entries that survive.
+// manifestOffset is the byte offset of the TOC/manifest member itself (as
+// returned alongside toc by tryFetchStargzTOC/tryFetchZstdChunkedTOC),
+// used to bound the last surviving entry's range GET so it doesn't run
+// into the manifest and footer that follow it. decompress turns the raw
+// bytes of a single entry's compressed member (gzip or zstd, depending on
+// which manifest format produced toc) into its content.
+func indexSeekableTOC(opts Options, bopts build.Options, toc *seekableTOC, manifestOffset int64, matcher func(string) bool, decompress func([]byte) ([]byte, error)) error {
+	builder, err := build.NewBuilder(bopts)
+	if err != nil {
+		return err
+	}
+	defer builder.Finish()
+
+	var wanted []seekableEntry
+	for _, e := range toc.Entries {
+		if e.Type != "reg" {
+			continue
+		}
+		if shouldIndex(e.Name, e.Size, bopts, matcher) {
+			wanted = append(wanted, e)
+		}
+	}
+	log.Printf("seekable manifest: %d/%d entries survive filtering", len(wanted), len(toc.Entries))
+
+	offsets := make([]int64, len(toc.Entries))
+	for i, e := range toc.Entries {
+		offsets[i] = e.Offset
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	for _, e := range wanted {
+		end := nextMemberStart(offsets, e.Offset, manifestOffset) - 1
+		raw, err := fetchRange(opts.Archive, e.Offset, end)
+		if err != nil {
+			return fmt.Errorf("fetching %s: %w", e.Name, err)
+		}
+		content, err := decompress(raw)
+		if err != nil {
+			return fmt.Errorf("decompressing %s: %w", e.Name, err)
+		}
+		if err := builder.Add(zoekt.Document{
+			Name:     stripComponents(e.Name, opts.Strip),
+			Content:  content,
+			Branches: []string{opts.Branch},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextMemberStart returns the offset immediately after the member that
+// starts at offset, i.e. the offset of whichever entry comes right after
+// it in the archive. sortedOffsets must hold every entry's offset in
+// ascending order (the caller builds this once per archive, not per call,
+// since bounding every surviving entry's range GET would otherwise mean
+// rescanning the full TOC for each one). If offset belongs to the last
+// entry, nextMemberStart returns manifestOffset: the TOC/manifest member
+// is always the next thing in the archive after the last entry's content,
+// so bounding the range GET there keeps it from running into the manifest
+// and footer bytes that follow.
+func nextMemberStart(sortedOffsets []int64, offset, manifestOffset int64) int64 {
+	i := sort.Search(len(sortedOffsets), func(i int) bool { return sortedOffsets[i] > offset })
+	if i == len(sortedOffsets) {
+		return manifestOffset
+	}
+	return sortedOffsets[i]
+}
+
+// --- seekable zstd manifest support ---
+//
+// This is our own seekable layout, not the zstd:chunked format produced by
+// containerd/stargz-snapshotter-style container tooling (that format's
+// manifest is itself zstd-compressed and carries a different footer and
+// digest scheme); only archives written in exactly the layout described
+// here are read this way. It borrows zstd:chunked's framing
+// idea, though: a sequence of independent zstd frames, one (or more, for
+// large files) per entry, followed by a manifest describing every entry's
+// name/size/offset. The manifest is wrapped in a zstd skippable frame
+// (magic 0x184D2A50-0x184D2A5F) so that zstd decoders that don't know about
+// this layout can skip over it transparently. We locate it the same way we
+// locate the eStargz TOC: fetch the tail of the archive and look for a
+// footer that records its offset.
+const (
+	zstdMagic             = 0x28B52FFD
+	zstdSkippableMagicMin = 0x184D2A50
+	zstdSkippableMagicMax = 0x184D2A5F
+
+	// zstdChunkedFooterSize is our fixed-size footer: an 8-byte big-endian
+	// manifest offset followed by the 4-byte skippable-frame magic that
+	// wraps the manifest, and 4 bytes of manifest frame payload length.
+	zstdChunkedFooterSize = 16
+)
+
+// tryFetchZstdChunkedTOC mirrors tryFetchStargzTOC but for our seekable
+// zstd manifest layout. It returns ok=false whenever the archive doesn't
+// carry one (including a real zstd:chunked manifest, which this does not
+// understand), in which case the caller should fall back.
+func tryFetchZstdChunkedTOC(url string) (toc *seekableTOC, manifestOffset int64, ok bool) {
+	size, rangesOK := headAcceptsRanges(url)
+	if !rangesOK || size < zstdChunkedFooterSize {
+		return nil, 0, false
+	}
+
+	start := size - stargzFooterFetchSize
+	if start < 0 {
+		start = 0
+	}
+	tail, err := fetchRange(url, start, size-1)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	footer := tail[len(tail)-zstdChunkedFooterSize:]
+	off, payloadLen, err := parseZstdChunkedFooter(footer)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	var manifestBytes []byte
+	manifestEnd := off + 8 + int64(payloadLen)
+	if off >= start {
+		manifestBytes = tail[off-start : manifestEnd-start]
+	} else {
+		manifestBytes, err = fetchRange(url, off, manifestEnd-1)
+		if err != nil {
+			return nil, 0, false
+		}
+	}
+
+	// Skippable frames are opaque: the payload right after the 8-byte
+	// magic+size header is the raw manifest, uncompressed.
+	raw := manifestBytes[8:]
+	toc = &seekableTOC{}
+	if err := json.Unmarshal(raw, toc); err != nil {
+		return nil, 0, false
+	}
+	return toc, off, true
+}
+
+// parseZstdChunkedFooter extracts the manifest's skippable-frame offset and
+// payload length from a zstdChunkedFooterSize-byte footer.
+func parseZstdChunkedFooter(footer []byte) (offset int64, payloadLen uint32, err error) {
+	if len(footer) != zstdChunkedFooterSize {
+		return 0, 0, fmt.Errorf("invalid footer length %d", len(footer))
+	}
+	offset = int64(binary.BigEndian.Uint64(footer[:8]))
+	magic := binary.LittleEndian.Uint32(footer[8:12])
+	if magic < zstdSkippableMagicMin || magic > zstdSkippableMagicMax {
+		return 0, 0, fmt.Errorf("not a zstd skippable frame: magic %#x", magic)
+	}
+	payloadLen = binary.LittleEndian.Uint32(footer[12:16])
+	return offset, payloadLen, nil
+}
+
+// decompressZstdMember decompresses a single independent zstd frame, as
+// used for one file's content in a zstd:chunked archive.
+func decompressZstdMember(b []byte) ([]byte, error) {
+	zr, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return zr.DecodeAll(b, nil)
+}